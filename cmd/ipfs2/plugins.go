@@ -0,0 +1,21 @@
+package main
+
+// PluginLoader is a minimal seam for downstream projects embedding go-ipfs
+// to register their own plugins before the node is initialized. This tree
+// does not yet have a plugin registry of its own, so PluginLoader has no
+// fields; it exists so BuildEnv.Preload has something concrete to hang off
+// of once one is added.
+type PluginLoader struct{}
+
+// LoadPlugins resolves the plugins found under repoPath (none, today) and
+// runs preload against the resulting loader before returning it, so callers
+// can inject their own plugins ahead of node initialization.
+func LoadPlugins(repoPath string, preload func(*PluginLoader) error) (*PluginLoader, error) {
+	pl := &PluginLoader{}
+	if preload != nil {
+		if err := preload(pl); err != nil {
+			return nil, err
+		}
+	}
+	return pl, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+)
+
+// profile modes accepted by --profile. heap and goroutine are dumped at
+// stop time via runtime/pprof's named profiles; cpu and trace need to be
+// started up front; block and mutex just need their sampling rate turned
+// on before the work we want to observe happens.
+const (
+	profileCPU       = "cpu"
+	profileHeap      = "heap"
+	profileBlock     = "block"
+	profileMutex     = "mutex"
+	profileTrace     = "trace"
+	profileGoroutine = "goroutine"
+)
+
+// startProfiling turns on every mode named in modes and returns a stop
+// closure, to be deferred as late as possible, that halts profiling and
+// writes out whichever profiles were enabled. Output files are named
+// ipfs.<mode>.prof (ipfs.trace.out for the execution trace) under dir, or
+// the current directory if dir is empty.
+//
+// This only covers the `ipfs` CLI process itself; pulling profiles out of
+// a running daemon without restarting it under --profile is handled by the
+// daemon's own /debug/pprof/* endpoint, which isn't wired up in this tree.
+func startProfiling(modes []string, dir string) (func(), error) {
+	var cpuFile, traceFile *os.File
+	enabled := make(map[string]bool, len(modes))
+
+	profilePath := func(mode string) string {
+		return filepath.Join(dir, "ipfs."+mode+".prof")
+	}
+
+	for _, mode := range modes {
+		mode = strings.TrimSpace(mode)
+		if mode == "" {
+			continue
+		}
+		enabled[mode] = true
+
+		switch mode {
+		case profileCPU:
+			f, err := os.Create(profilePath(mode))
+			if err != nil {
+				return nil, err
+			}
+			cpuFile = f
+			if err := pprof.StartCPUProfile(cpuFile); err != nil {
+				return nil, err
+			}
+
+		case profileBlock:
+			runtime.SetBlockProfileRate(1)
+
+		case profileMutex:
+			runtime.SetMutexProfileFraction(1)
+
+		case profileTrace:
+			f, err := os.Create(filepath.Join(dir, "ipfs.trace.out"))
+			if err != nil {
+				return nil, err
+			}
+			traceFile = f
+			if err := trace.Start(traceFile); err != nil {
+				return nil, err
+			}
+
+		case profileHeap, profileGoroutine:
+			// nothing to start; dumped by stop() below.
+
+		default:
+			return nil, fmt.Errorf("unknown --profile mode %q", mode)
+		}
+	}
+
+	stop := func() {
+		if enabled[profileCPU] {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+		if enabled[profileTrace] {
+			trace.Stop()
+			traceFile.Close()
+		}
+		if enabled[profileHeap] {
+			if err := writeRuntimeProfile(profileHeap, profilePath(profileHeap)); err != nil {
+				log.Critical(err)
+			}
+		}
+		if enabled[profileGoroutine] {
+			if err := writeRuntimeProfile(profileGoroutine, profilePath(profileGoroutine)); err != nil {
+				log.Critical(err)
+			}
+		}
+		if enabled[profileBlock] {
+			if err := writeRuntimeProfile(profileBlock, profilePath(profileBlock)); err != nil {
+				log.Critical(err)
+			}
+			runtime.SetBlockProfileRate(0)
+		}
+		if enabled[profileMutex] {
+			if err := writeRuntimeProfile(profileMutex, profilePath(profileMutex)); err != nil {
+				log.Critical(err)
+			}
+			runtime.SetMutexProfileFraction(0)
+		}
+	}
+	return stop, nil
+}
+
+func writeRuntimeProfile(name, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pprof.Lookup(name).WriteTo(f, 0)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	cmds "github.com/jbenet/go-ipfs/commands"
+)
+
+// ProgressEvent is one update emitted on a cmds.Response's progress
+// channel while a long-running command (add, pin, refs, ...) is still
+// working, so the CLI has something to show besides a blocked io.Copy.
+type ProgressEvent struct {
+	Token       string
+	Title       string
+	Message     string
+	Percent     float64
+	Cancellable bool
+}
+
+// progressResponse is satisfied by any cmds.Response that can report
+// progress and be canceled mid-flight. It's declared here rather than
+// added to the commands package's Response interface, because that
+// package (along with commands/http and daemon2) isn't part of this
+// source tree and can't be edited from here.
+//
+// That means this file only covers the CLI-local half of this backlog
+// item: nothing in the (missing) commands/http client adds an
+// X-IPFS-Request-ID-style progress sideband to client.Send's HTTP
+// transport, and no command in this tree has a Response implementing
+// progressResponse yet. Until both of those land, res.(progressResponse)
+// below never succeeds, add/pin/refs show no progress, and Ctrl-C cannot
+// cancel a remote daemon operation — wireProgress is scaffolding for the
+// local case, not a finished implementation of the request.
+type progressResponse interface {
+	Progress() <-chan ProgressEvent
+	Cancel()
+}
+
+// renderProgress drains events and renders them to stderr: a single
+// rewritten line while attached to a terminal, or newline-delimited JSON
+// otherwise (piped output, or --encoding=json), so scripts can consume it.
+func renderProgress(events <-chan ProgressEvent, asJSON bool) {
+	enc := json.NewEncoder(os.Stderr)
+	for ev := range events {
+		if asJSON {
+			enc.Encode(ev)
+			continue
+		}
+		if ev.Percent > 0 {
+			fmt.Fprintf(os.Stderr, "\r%s: %s (%.0f%%)\x1b[K", ev.Title, ev.Message, ev.Percent)
+		} else {
+			fmt.Fprintf(os.Stderr, "\r%s: %s\x1b[K", ev.Title, ev.Message)
+		}
+	}
+	if !asJSON {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// isTerminal reports whether f looks like an interactive terminal rather
+// than a pipe or redirected file, so renderProgress knows whether it's safe
+// to rewrite a single line in place.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// wireProgress hooks up res's progress reporting, if it has any, to stderr,
+// and cancels it as soon as ctx is done (the first SIGINT, see
+// handleInterrupt) instead of leaving the user staring at a stalled
+// terminal until the second SIGINT kills the process outright. See the
+// progressResponse doc comment for what this does and does not cover yet.
+func wireProgress(ctx context.Context, res cmds.Response, asJSON bool) {
+	pr, ok := res.(progressResponse)
+	if !ok {
+		return
+	}
+
+	go renderProgress(pr.Progress(), asJSON)
+	go func() {
+		<-ctx.Done()
+		pr.Cancel()
+	}()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// newRequestID returns a random v4 UUID, used to stamp each invocation (as
+// its "reqid" option) so its log lines can be correlated with each other.
+//
+// Today that correlation only covers the handful of log lines reqLogger is
+// used for inside callCommand. It does not reach logging done inside
+// root.Call, core.NewIpfsNode, or a command's own Run, and it does not
+// cross the wire: commands/http (client.Send) doesn't forward reqid as a
+// header, and daemon2's HTTP handler doesn't inject it into the request
+// context it logs against. None of those three packages are part of this
+// source tree, so "grep daemon logs for one invocation" isn't achieved
+// yet — this is the CLI-local groundwork for it.
+func newRequestID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // variant 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// reqLogger returns a logging helper that prefixes every message with
+// reqID, so the log lines callCommand writes with it can be grepped for a
+// single invocation.
+func reqLogger(reqID string) func(format string, args ...interface{}) {
+	return func(format string, args ...interface{}) {
+		log.Infof("[%s] "+format, append([]interface{}{reqID}, args...)...)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+
+func TestRouteDecision(t *testing.T) {
+	cases := []struct {
+		name          string
+		details       cmdDetails
+		daemonRunning bool
+		apiSpecified  bool
+		wantRoute     route
+		wantErr       bool
+	}{
+		{
+			name:          "plain command, daemon up",
+			details:       cmdDetails{},
+			daemonRunning: true,
+			wantRoute:     routeDaemon,
+		},
+		{
+			name:          "plain command, daemon down",
+			details:       cmdDetails{},
+			daemonRunning: false,
+			wantRoute:     routeLocal,
+		},
+		{
+			name:          "doesNotUseRepo (init/version) always runs local, daemon up",
+			details:       cmdDetails{doesNotUseRepo: true, cannotRunOnDaemon: true},
+			daemonRunning: true,
+			wantRoute:     routeLocal,
+		},
+		{
+			name:          "cannotRunOnDaemon (repo gc) with daemon up falls back to local",
+			details:       cmdDetails{cannotRunOnDaemon: true},
+			daemonRunning: true,
+			wantRoute:     routeLocal,
+		},
+		{
+			name:          "cannotRunOnDaemon with --api pinned and daemon up errors instead of silently going local",
+			details:       cmdDetails{cannotRunOnDaemon: true},
+			daemonRunning: true,
+			apiSpecified:  true,
+			wantErr:       true,
+		},
+		{
+			name:          "preemptsAutoUpdate (daemon) routed local even though it uses the repo",
+			details:       cmdDetails{cannotRunOnDaemon: true, preemptsAutoUpdate: true},
+			daemonRunning: true,
+			wantRoute:     routeLocal,
+		},
+		{
+			name:          "cannotRunOnClient (bootstrap, swarm) dispatches to a reachable daemon",
+			details:       cmdDetails{cannotRunOnClient: true},
+			daemonRunning: true,
+			wantRoute:     routeDaemon,
+		},
+		{
+			name:          "cannotRunOnClient with no daemon reachable errors rather than running locally",
+			details:       cmdDetails{cannotRunOnClient: true},
+			daemonRunning: false,
+			wantErr:       true,
+		},
+		{
+			name:          "plain command with --api pinned and daemon unreachable errors instead of falling back",
+			details:       cmdDetails{},
+			daemonRunning: false,
+			apiSpecified:  true,
+			wantErr:       true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := routeDecision([]string{"test"}, c.details, c.daemonRunning, c.apiSpecified, "/ip4/127.0.0.1/tcp/5001")
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("routeDecision() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("routeDecision() unexpected error: %v", err)
+			}
+			if got != c.wantRoute {
+				t.Fatalf("routeDecision() = %v, want %v", got, c.wantRoute)
+			}
+		})
+	}
+}